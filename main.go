@@ -6,12 +6,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,18 +32,246 @@ type Config struct {
 	// This will be provided through Traefik's plugin configuration
 	Conf    string        `json:"conf,omitempty"`
 	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// RefreshEndpoint, when set, is the full URL the plugin POSTs a refresh
+	// token to in order to obtain a new access token before it expires.
+	RefreshEndpoint string `json:"refreshEndpoint,omitempty"`
+	// RefreshSkew is how far ahead of the access token's expiry the plugin
+	// proactively refreshes it. Defaults to 60s.
+	RefreshSkew time.Duration `json:"refreshSkew,omitempty"`
+	// TokenMetaSecret signs the token_meta cookie that records the access
+	// token's expiry so it can't be tampered with by the client. Required
+	// for RefreshEndpoint to be honored.
+	TokenMetaSecret string `json:"tokenMetaSecret,omitempty"`
+
+	// MaxCookieBytes is the largest value a single cookie may carry before
+	// the access token is split across token_0, token_1, ... chunk
+	// cookies. Defaults to 3800, leaving headroom under the 4KB browser
+	// limit for cookie attributes.
+	MaxCookieBytes int `json:"maxCookieBytes,omitempty"`
+
+	// AuthzPlugins, when set, switches the plugin into Docker authz-style
+	// mode: each request is serialized as a JSON envelope and POSTed, in
+	// order, to every plugin in this list instead of the fixed Conf
+	// GET+header check. Entries may be a full URL or a "unix://" socket
+	// path.
+	AuthzPlugins []string `json:"authzPlugins,omitempty"`
+	// RequestBodyLimit caps how many bytes of the request body are
+	// buffered and forwarded to authz plugins. Defaults to 10MiB.
+	RequestBodyLimit int64 `json:"requestBodyLimit,omitempty"`
+
+	// SkipPaths bypasses the entire auth roundtrip for matching paths,
+	// forwarding straight to the next handler. An entry ending in "*" is
+	// matched as a prefix (e.g. "/.well-known/acme-challenge/*"); anything
+	// else must match the request path exactly.
+	SkipPaths []string `json:"skipPaths,omitempty"`
+	// SkipPathsRegex is the regex form of SkipPaths, for patterns a simple
+	// prefix/exact match can't express.
+	SkipPathsRegex []string `json:"skipPathsRegex,omitempty"`
+
+	// RequireHeadersPaths maps a path prefix to header names that must be
+	// present on matching requests; they're forwarded to the auth server
+	// alongside x-api-key and x-account. The longest matching prefix wins.
+	RequireHeadersPaths map[string][]string `json:"requireHeadersPaths,omitempty"`
+
+	// SigningSecret, when set, enables session binding: the plugin signs
+	// an HMAC over the request Host (and, with BindToAccount, the
+	// x-account header) and the access token into a token_sig cookie, and
+	// rejects a token cookie replayed against a different host or tenant.
+	SigningSecret string `json:"signingSecret,omitempty"`
+	// BindToAccount additionally binds the session signature to the
+	// x-account header, rejecting replay across tenants on the same host.
+	// Requires SigningSecret.
+	BindToAccount bool `json:"bindToAccount,omitempty"`
+
+	// MaxRetries is how many additional attempts are made against the auth
+	// server on a transport error or a RetryOn status code, with
+	// exponential backoff and jitter between attempts. Defaults to 2.
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// RetryOn lists the auth server status codes that trigger a retry.
+	// Defaults to 502, 503, 504.
+	RetryOn []int `json:"retryOn,omitempty"`
+
+	// BreakerThreshold is how many auth server failures within
+	// BreakerWindow open the circuit breaker for BreakerCooldown. Defaults
+	// to 5.
+	BreakerThreshold int `json:"breakerThreshold,omitempty"`
+	// BreakerWindow is the rolling window failures are counted over.
+	// Defaults to 30s.
+	BreakerWindow time.Duration `json:"breakerWindow,omitempty"`
+	// BreakerCooldown is how long the breaker stays open before allowing a
+	// single half-open probe request through. Defaults to 30s.
+	BreakerCooldown time.Duration `json:"breakerCooldown,omitempty"`
+	// FailOpen forwards requests straight to next while the breaker is
+	// open, instead of failing with 503.
+	FailOpen bool `json:"failOpen,omitempty"`
+
+	// MetricsPath, when set, serves Prometheus-style auth_requests_total
+	// and auth_breaker_state metrics at this path.
+	MetricsPath string `json:"metricsPath,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		Timeout: 30 * time.Second,
+		Timeout:        30 * time.Second,
+		RefreshSkew:    60 * time.Second,
+		MaxCookieBytes: 3800,
 	}
 }
 
 // authResponse represents the expected structure of the auth server response.
 type authResponse struct {
-	AccessToken string `json:"accessToken"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	ExpiresIn    int64  `json:"expiresIn,omitempty"`
+}
+
+// refreshCall represents a refresh in flight, shared by requests that race
+// on the same refresh token.
+type refreshCall struct {
+	done   chan struct{}
+	result authResponse
+	err    error
+}
+
+// authzRequest is the JSON envelope POSTed to configured authz plugins,
+// mirroring the Docker authorization plugin protocol.
+type authzRequest struct {
+	User           string            `json:"User"`
+	RequestMethod  string            `json:"RequestMethod"`
+	RequestURI     string            `json:"RequestURI"`
+	RequestHeaders map[string]string `json:"RequestHeaders"`
+	RequestBody    []byte            `json:"RequestBody,omitempty"`
+}
+
+// authzResponse is the decision an authz plugin returns for an authzRequest.
+type authzResponse struct {
+	Allow           bool              `json:"Allow"`
+	Msg             string            `json:"Msg,omitempty"`
+	Err             string            `json:"Err,omitempty"`
+	ModifiedHeaders map[string]string `json:"ModifiedHeaders,omitempty"`
+}
+
+// breakerState is the circuit breaker's current state.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker trips after threshold failures within window, staying
+// open for cooldown before allowing a single half-open probe through.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu               sync.Mutex
+	state            breakerState
+	failures         []time.Time
+	openedAt         time.Time
+	halfOpenInFlight bool
+}
+
+// allow reports whether a request may proceed, claiming the single
+// half-open probe slot when the cooldown has elapsed.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.halfOpenInFlight = true
+		return true
+	case breakerHalfOpen:
+		if b.halfOpenInFlight {
+			return false
+		}
+		b.halfOpenInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// recordSuccess closes the breaker and clears its failure history.
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.halfOpenInFlight = false
+	b.failures = nil
+}
+
+// recordFailure tracks a failure and opens the breaker if it pushes the
+// rolling window's failure count to the threshold, or if the failing
+// request was the half-open probe.
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == breakerHalfOpen {
+		b.halfOpenInFlight = false
+		b.state = breakerOpen
+		b.openedAt = now
+		b.failures = nil
+		return
+	}
+
+	kept := b.failures[:0]
+	cutoff := now.Add(-b.window)
+	for _, t := range b.failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	b.failures = append(kept, now)
+
+	if len(b.failures) >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
+
+// currentState reports the breaker's state, for the auth_breaker_state
+// metric.
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// authMetrics accumulates the auth_requests_total counters.
+type authMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (m *authMetrics) inc(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int64)
+	}
+	m.counts[result]++
+}
+
+func (m *authMetrics) snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]int64, len(m.counts))
+	for k, v := range m.counts {
+		out[k] = v
+	}
+	return out
 }
 
 // AuthPlugin holds the necessary components for the plugin.
@@ -42,17 +281,48 @@ type AuthPlugin struct {
 	endpointPath string
 	timeout      time.Duration
 	name         string
+
+	refreshHost     string
+	refreshPath     string
+	refreshSkew     time.Duration
+	tokenMetaSecret string
+
+	refreshMu       sync.Mutex
+	refreshInFlight map[string]*refreshCall
+
+	maxCookieBytes int
+
+	authzPlugins     []string
+	requestBodyLimit int64
+
+	skipPaths           []string
+	skipPathsRegex      []*regexp.Regexp
+	requireHeadersPaths map[string][]string
+
+	sessionSigningSecret string
+	bindToAccount        bool
+
+	maxRetries  int
+	retryOn     map[int]bool
+	breaker     *circuitBreaker
+	failOpen    bool
+	metricsPath string
+	metrics     *authMetrics
 }
 
 // New creates a new instance of the plugin.
 func New(_ context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if config.Conf == "" {
+	if config.Conf == "" && len(config.AuthzPlugins) == 0 {
 		return nil, fmt.Errorf("conf cannot be empty")
 	}
 
-	parsedURL, err := url.Parse(config.Conf)
-	if err != nil {
-		return nil, fmt.Errorf("invalid auth endpoint URL: %v", err)
+	var endpointHost, endpointPath string
+	if config.Conf != "" {
+		parsedURL, err := url.Parse(config.Conf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth endpoint URL: %v", err)
+		}
+		endpointHost, endpointPath = parsedURL.Host, parsedURL.Path
 	}
 
 	timeout := config.Timeout
@@ -60,17 +330,128 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 		timeout = 30 * time.Second
 	}
 
-	return &AuthPlugin{
-		next:         next,
-		endpointHost: parsedURL.Host,
-		endpointPath: parsedURL.Path,
-		timeout:      timeout,
-		name:         name,
-	}, nil
+	refreshSkew := config.RefreshSkew
+	if refreshSkew == 0 {
+		refreshSkew = 60 * time.Second
+	}
+
+	maxCookieBytes := config.MaxCookieBytes
+	if maxCookieBytes == 0 {
+		maxCookieBytes = 3800
+	}
+
+	requestBodyLimit := config.RequestBodyLimit
+	if requestBodyLimit == 0 {
+		requestBodyLimit = 10 << 20
+	}
+
+	skipPathsRegex := make([]*regexp.Regexp, 0, len(config.SkipPathsRegex))
+	for _, pattern := range config.SkipPathsRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid skipPathsRegex pattern %q: %v", pattern, err)
+		}
+		skipPathsRegex = append(skipPathsRegex, re)
+	}
+
+	if config.BindToAccount && config.SigningSecret == "" {
+		return nil, fmt.Errorf("signingSecret cannot be empty when bindToAccount is enabled")
+	}
+
+	maxRetries := config.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 2
+	}
+
+	retryOnCodes := config.RetryOn
+	if len(retryOnCodes) == 0 {
+		retryOnCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	retryOn := make(map[int]bool, len(retryOnCodes))
+	for _, code := range retryOnCodes {
+		retryOn[code] = true
+	}
+
+	breakerThreshold := config.BreakerThreshold
+	if breakerThreshold == 0 {
+		breakerThreshold = 5
+	}
+	breakerWindow := config.BreakerWindow
+	if breakerWindow == 0 {
+		breakerWindow = 30 * time.Second
+	}
+	breakerCooldown := config.BreakerCooldown
+	if breakerCooldown == 0 {
+		breakerCooldown = 30 * time.Second
+	}
+
+	a := &AuthPlugin{
+		next:                 next,
+		endpointHost:         endpointHost,
+		endpointPath:         endpointPath,
+		timeout:              timeout,
+		name:                 name,
+		refreshSkew:          refreshSkew,
+		tokenMetaSecret:      config.TokenMetaSecret,
+		refreshInFlight:      make(map[string]*refreshCall),
+		maxCookieBytes:       maxCookieBytes,
+		authzPlugins:         config.AuthzPlugins,
+		requestBodyLimit:     requestBodyLimit,
+		skipPaths:            config.SkipPaths,
+		skipPathsRegex:       skipPathsRegex,
+		requireHeadersPaths:  config.RequireHeadersPaths,
+		sessionSigningSecret: config.SigningSecret,
+		bindToAccount:        config.BindToAccount,
+		maxRetries:           maxRetries,
+		retryOn:              retryOn,
+		breaker: &circuitBreaker{
+			threshold: breakerThreshold,
+			window:    breakerWindow,
+			cooldown:  breakerCooldown,
+		},
+		failOpen:    config.FailOpen,
+		metricsPath: config.MetricsPath,
+		metrics:     &authMetrics{},
+	}
+
+	if config.RefreshEndpoint != "" {
+		if config.TokenMetaSecret == "" {
+			return nil, fmt.Errorf("tokenMetaSecret cannot be empty when refreshEndpoint is set")
+		}
+		refreshURL, err := url.Parse(config.RefreshEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refresh endpoint URL: %v", err)
+		}
+		a.refreshHost = refreshURL.Host
+		a.refreshPath = refreshURL.Path
+	}
+
+	return a, nil
 }
 
 // ServeHTTP implements the middleware logic.
 func (a *AuthPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if a.metricsPath != "" && req.URL.Path == a.metricsPath {
+		a.serveMetrics(rw)
+		return
+	}
+
+	if a.shouldSkip(req.URL.Path) {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if a.sessionSigningSecret != "" && !a.verifySessionBinding(req) {
+		a.clearAuthCookies(rw, req)
+		http.Error(rw, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if len(a.authzPlugins) > 0 {
+		a.serveAuthz(rw, req)
+		return
+	}
+
 	// Extract required headers.
 	apiKey := req.Header.Get("x-api-key")
 	tenant := req.Header.Get("x-account")
@@ -79,6 +460,24 @@ func (a *AuthPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	requiredHeaders := a.requireHeadersFor(req.URL.Path)
+	for _, header := range requiredHeaders {
+		if req.Header.Get(header) == "" {
+			http.Error(rw, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if a.refreshHost != "" {
+		if refreshed, ok := a.maybeRefresh(rw, req); ok {
+			if !refreshed {
+				return
+			}
+			a.next.ServeHTTP(rw, req)
+			return
+		}
+	}
+
 	// Build the auth server URL using plain HTTP.
 	authURL := fmt.Sprintf("http://%s%s", a.endpointHost, a.endpointPath)
 	fmt.Println("Auth URL:", authURL)
@@ -92,28 +491,29 @@ func (a *AuthPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// Pass along the necessary headers.
 	authReq.Header.Set("x-api-key", apiKey)
 	authReq.Header.Set("x-account", tenant)
-
-	// Perform the auth request.
-	client := &http.Client{
-		Timeout: a.timeout,
+	for _, header := range requiredHeaders {
+		authReq.Header.Set(header, req.Header.Get(header))
 	}
-	resp, err := client.Do(authReq)
-	if err != nil {
-		http.Error(rw, `{"error": "Internal error"}`, http.StatusInternalServerError)
+
+	// Perform the auth request, with retries and circuit breaking.
+	result, breakerOpen, err := a.callAuthServer(authReq)
+	if breakerOpen {
+		if a.failOpen {
+			a.next.ServeHTTP(rw, req)
+			return
+		}
+		http.Error(rw, `{"error": "Service unavailable"}`, http.StatusServiceUnavailable)
 		return
 	}
-	defer resp.Body.Close()
-
-	// Read the response body.
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		http.Error(rw, `{"error": "Internal error"}`, http.StatusInternalServerError)
 		return
 	}
+	body := result.body
 
 	// Propagate non-200 responses from the auth server.
-	if resp.StatusCode != http.StatusOK {
-		rw.WriteHeader(resp.StatusCode)
+	if result.statusCode != http.StatusOK {
+		rw.WriteHeader(result.statusCode)
 		_, _ = rw.Write(body)
 		return
 	}
@@ -125,23 +525,613 @@ func (a *AuthPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Set a cookie in the response with the access token.
-	cookie := &http.Cookie{
-		Name:     "token",
-		Value:    authResp.AccessToken,
+	a.setAuthCookies(rw, req, authResp)
+
+	// Continue with the next handler.
+	a.next.ServeHTTP(rw, req)
+}
+
+// maybeRefresh checks whether the caller's access token is close to expiry
+// and, if so, synchronously refreshes it before the request proceeds. The
+// second return value reports whether the request was handled as a refresh
+// attempt at all; when true, the first return value reports whether it
+// succeeded (false means a response has already been written and the
+// caller must stop).
+func (a *AuthPlugin) maybeRefresh(rw http.ResponseWriter, req *http.Request) (bool, bool) {
+	accessToken, err := a.readTokenCookie(req)
+	if err != nil {
+		return false, false
+	}
+
+	if !a.tokenNeedsRefresh(req, accessToken) {
+		return false, false
+	}
+
+	refreshCookie, err := req.Cookie("refresh_token")
+	if err != nil {
+		a.clearAuthCookies(rw, req)
+		http.Error(rw, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return false, true
+	}
+
+	authResp, err := a.refreshOnce(refreshCookie.Value)
+	if err != nil {
+		a.clearAuthCookies(rw, req)
+		http.Error(rw, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return false, true
+	}
+
+	a.setAuthCookies(rw, req, authResp)
+	return true, true
+}
+
+// readTokenCookie reassembles the access token from its chunked token_0,
+// token_1, ... cookies when a token_chunks cookie is present, falling back
+// to the plain token cookie otherwise.
+func (a *AuthPlugin) readTokenCookie(req *http.Request) (string, error) {
+	chunksCookie, err := req.Cookie("token_chunks")
+	if err != nil {
+		cookie, err := req.Cookie("token")
+		if err != nil {
+			return "", err
+		}
+		return cookie.Value, nil
+	}
+
+	n, err := strconv.Atoi(chunksCookie.Value)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid token_chunks cookie")
+	}
+
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		chunk, err := req.Cookie(fmt.Sprintf("token_%d", i))
+		if err != nil {
+			return "", fmt.Errorf("missing token chunk %d: %v", i, err)
+		}
+		sb.WriteString(chunk.Value)
+	}
+	return sb.String(), nil
+}
+
+// tokenNeedsRefresh reports whether the access token is expired or within
+// the configured refresh skew of expiring. It first consults the signed
+// token_meta cookie and falls back to decoding the access token's JWT exp
+// claim (without verifying the signature, since the auth server already
+// vouched for it).
+func (a *AuthPlugin) tokenNeedsRefresh(req *http.Request, accessToken string) bool {
+	expiry, ok := a.expiryFromMetaCookie(req)
+	if !ok {
+		expiry, ok = expiryFromJWT(accessToken)
+		if !ok {
+			return false
+		}
+	}
+	return time.Now().Add(a.refreshSkew).After(expiry)
+}
+
+// expiryFromMetaCookie reads and verifies the signed token_meta cookie.
+func (a *AuthPlugin) expiryFromMetaCookie(req *http.Request) (time.Time, bool) {
+	metaCookie, err := req.Cookie("token_meta")
+	if err != nil {
+		return time.Time{}, false
+	}
+	parts := strings.SplitN(metaCookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	unixSeconds, sig := parts[0], parts[1]
+	if !hmac.Equal([]byte(sig), []byte(a.signMeta(unixSeconds))) {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(unixSeconds, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// signMeta computes the HMAC-SHA256 of value using the configured
+// tokenMetaSecret, hex-encoded.
+func (a *AuthPlugin) signMeta(value string) string {
+	mac := hmac.New(sha256.New, []byte(a.tokenMetaSecret))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// expiryFromJWT decodes the exp claim from a JWT's payload segment without
+// verifying its signature.
+func expiryFromJWT(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// refreshOnce performs the refresh call for refreshToken, coalescing
+// concurrent callers for the same refresh token into a single upstream
+// request.
+func (a *AuthPlugin) refreshOnce(refreshToken string) (authResponse, error) {
+	a.refreshMu.Lock()
+	if call, ok := a.refreshInFlight[refreshToken]; ok {
+		a.refreshMu.Unlock()
+		<-call.done
+		return call.result, call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	a.refreshInFlight[refreshToken] = call
+	a.refreshMu.Unlock()
+
+	call.result, call.err = a.doRefresh(refreshToken)
+
+	a.refreshMu.Lock()
+	delete(a.refreshInFlight, refreshToken)
+	a.refreshMu.Unlock()
+	close(call.done)
+
+	return call.result, call.err
+}
+
+// doRefresh POSTs the refresh token to the configured refresh endpoint and
+// parses the resulting access/refresh token pair.
+func (a *AuthPlugin) doRefresh(refreshToken string) (authResponse, error) {
+	refreshURL := fmt.Sprintf("http://%s%s", a.refreshHost, a.refreshPath)
+	payload, err := json.Marshal(map[string]string{"refreshToken": refreshToken})
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	refreshReq, err := http.NewRequest(http.MethodPost, refreshURL, bytes.NewReader(payload))
+	if err != nil {
+		return authResponse{}, err
+	}
+	refreshReq.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: a.timeout}
+	resp, err := client.Do(refreshReq)
+	if err != nil {
+		return authResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return authResponse{}, fmt.Errorf("refresh endpoint returned status %d", resp.StatusCode)
+	}
+
+	var authResp authResponse
+	if err := json.Unmarshal(body, &authResp); err != nil {
+		return authResponse{}, err
+	}
+	return authResp, nil
+}
+
+// verifySessionBinding checks that a present token cookie carries a
+// token_sig matching the current request's Host (and, with BindToAccount,
+// x-account), rejecting a token replayed against a different host/tenant.
+// A request with no token cookie at all has nothing to verify.
+func (a *AuthPlugin) verifySessionBinding(req *http.Request) bool {
+	accessToken, err := a.readTokenCookie(req)
+	if err != nil {
+		return true
+	}
+
+	sigCookie, err := req.Cookie("token_sig")
+	if err != nil {
+		return false
+	}
+
+	account := ""
+	if a.bindToAccount {
+		account = req.Header.Get("x-account")
+	}
+	expected := a.signSession(req.Host, account, accessToken)
+	return hmac.Equal([]byte(sigCookie.Value), []byte(expected))
+}
+
+// signSession computes the HMAC-SHA256 binding a session to host, account
+// and accessToken, hex-encoded.
+func (a *AuthPlugin) signSession(host, account, accessToken string) string {
+	mac := hmac.New(sha256.New, []byte(a.sessionSigningSecret))
+	mac.Write([]byte(host))
+	mac.Write([]byte{0})
+	mac.Write([]byte(account))
+	mac.Write([]byte{0})
+	mac.Write([]byte(accessToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shouldSkip reports whether path matches one of the configured SkipPaths
+// or SkipPathsRegex entries and should bypass auth entirely.
+func (a *AuthPlugin) shouldSkip(path string) bool {
+	for _, p := range a.skipPaths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	for _, re := range a.skipPathsRegex {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireHeadersFor returns the extra headers required for path, per the
+// longest matching RequireHeadersPaths prefix.
+func (a *AuthPlugin) requireHeadersFor(path string) []string {
+	var longestPrefix string
+	var headers []string
+	for prefix, names := range a.requireHeadersPaths {
+		if len(prefix) > len(longestPrefix) && strings.HasPrefix(path, prefix) {
+			longestPrefix = prefix
+			headers = names
+		}
+	}
+	return headers
+}
+
+// authCallResult is a completed auth server response.
+type authCallResult struct {
+	statusCode int
+	body       []byte
+}
+
+// callAuthServer performs authReq against the auth server, retrying on a
+// transport error or a RetryOn status code with exponential backoff and
+// jitter, and recording the outcome against the circuit breaker. The
+// second return value reports whether the breaker was open, in which case
+// the request was never attempted and the caller decides whether to fail
+// closed or open.
+func (a *AuthPlugin) callAuthServer(authReq *http.Request) (authCallResult, bool, error) {
+	if !a.breaker.allow() {
+		a.metrics.inc("breaker_open")
+		return authCallResult{}, true, nil
+	}
+
+	client := &http.Client{Timeout: a.timeout}
+
+	var lastErr error
+	for attempt := 0; attempt <= a.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBackoff(attempt))
+			a.metrics.inc("retry")
+		}
+
+		resp, err := client.Do(authReq)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if a.retryOn[resp.StatusCode] && attempt < a.maxRetries {
+			lastErr = fmt.Errorf("auth server returned status %d", resp.StatusCode)
+			continue
+		}
+
+		success := resp.StatusCode < http.StatusInternalServerError
+		a.recordOutcome(success)
+		return authCallResult{statusCode: resp.StatusCode, body: body}, false, nil
+	}
+
+	a.recordOutcome(false)
+	return authCallResult{}, false, lastErr
+}
+
+// recordOutcome feeds a completed auth call's result into the circuit
+// breaker and the auth_requests_total counters.
+func (a *AuthPlugin) recordOutcome(success bool) {
+	if success {
+		a.breaker.recordSuccess()
+		a.metrics.inc("success")
+		return
+	}
+	a.breaker.recordFailure()
+	a.metrics.inc("failure")
+}
+
+// retryBackoff returns the exponential backoff with jitter to wait before
+// retry attempt n (n >= 1).
+func retryBackoff(attempt int) time.Duration {
+	base := 50 * time.Millisecond * time.Duration(uint(1)<<uint(attempt-1))
+	return base + time.Duration(rand.Int63n(int64(base)))
+}
+
+// serveMetrics renders the auth_requests_total and auth_breaker_state
+// Prometheus metrics.
+func (a *AuthPlugin) serveMetrics(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counts := a.metrics.snapshot()
+	fmt.Fprintln(rw, "# HELP auth_requests_total Total auth backend requests by result.")
+	fmt.Fprintln(rw, "# TYPE auth_requests_total counter")
+	for _, result := range []string{"success", "failure", "retry", "breaker_open"} {
+		fmt.Fprintf(rw, "auth_requests_total{result=%q} %d\n", result, counts[result])
+	}
+
+	fmt.Fprintln(rw, "# HELP auth_breaker_state Circuit breaker state (0=closed, 1=open, 2=half_open).")
+	fmt.Fprintln(rw, "# TYPE auth_breaker_state gauge")
+	fmt.Fprintf(rw, "auth_breaker_state %d\n", a.breaker.currentState())
+}
+
+// serveAuthz implements the Docker authz-style operating mode: it
+// serializes the request, consults each configured authz plugin in order,
+// and either rejects the request or merges in the headers the plugins
+// returned before forwarding to a.next.
+func (a *AuthPlugin) serveAuthz(rw http.ResponseWriter, req *http.Request) {
+	var bodyBytes []byte
+	if req.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(req.Body, a.requestBodyLimit+1))
+		req.Body.Close()
+		if err != nil {
+			http.Error(rw, `{"error": "Internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		if int64(len(body)) > a.requestBodyLimit {
+			http.Error(rw, `{"error": "Request body too large"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+		bodyBytes = body
+		req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	}
+
+	headers := make(map[string]string, len(req.Header))
+	for k, v := range req.Header {
+		headers[k] = strings.Join(v, ",")
+	}
+
+	envelope := authzRequest{
+		User:           req.Header.Get("x-account"),
+		RequestMethod:  req.Method,
+		RequestURI:     req.URL.RequestURI(),
+		RequestHeaders: headers,
+		RequestBody:    bodyBytes,
+	}
+
+	for _, plugin := range a.authzPlugins {
+		authzResp, err := a.callAuthzPlugin(plugin, envelope)
+		if err != nil {
+			http.Error(rw, `{"error": "Internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !authzResp.Allow {
+			msg := authzResp.Msg
+			if msg == "" {
+				msg = authzResp.Err
+			}
+			body, _ := json.Marshal(map[string]string{"error": msg})
+			http.Error(rw, string(body), http.StatusForbidden)
+			return
+		}
+		for k, v := range authzResp.ModifiedHeaders {
+			req.Header.Set(k, v)
+		}
+	}
+
+	a.next.ServeHTTP(rw, req)
+}
+
+// callAuthzPlugin POSTs envelope to the given authz plugin, which may be
+// addressed by a full URL or, with a "unix://" scheme, a Unix socket path.
+func (a *AuthPlugin) callAuthzPlugin(plugin string, envelope authzRequest) (authzResponse, error) {
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return authzResponse{}, err
+	}
+
+	client := &http.Client{Timeout: a.timeout}
+	target := plugin
+	if socketPath, ok := strings.CutPrefix(plugin, "unix://"); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		target = "http://unix/AuthZPlugin.AuthZReq"
+	}
+
+	authzReq, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return authzResponse{}, err
+	}
+	authzReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(authzReq)
+	if err != nil {
+		return authzResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return authzResponse{}, err
+	}
+
+	var authzResp authzResponse
+	if err := json.Unmarshal(body, &authzResp); err != nil {
+		return authzResponse{}, err
+	}
+	return authzResp, nil
+}
+
+// setAuthCookies writes the access token cookie and, when the auth response
+// carries them, the refresh token and signed expiry metadata cookies.
+func (a *AuthPlugin) setAuthCookies(rw http.ResponseWriter, req *http.Request, authResp authResponse) {
+	a.writeTokenCookie(rw, req, authResp.AccessToken)
+
+	if authResp.RefreshToken != "" {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     "refresh_token",
+			Value:    authResp.RefreshToken,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+		})
+	}
+
+	if a.sessionSigningSecret != "" {
+		account := ""
+		if a.bindToAccount {
+			account = req.Header.Get("x-account")
+		}
+		http.SetCookie(rw, &http.Cookie{
+			Name:     "token_sig",
+			Value:    a.signSession(req.Host, account, authResp.AccessToken),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+		})
+	}
+
+	if a.tokenMetaSecret == "" {
+		return
+	}
+
+	expiry, ok := time.Time{}, false
+	if authResp.ExpiresIn > 0 {
+		expiry, ok = time.Now().Add(time.Duration(authResp.ExpiresIn)*time.Second), true
+	} else {
+		expiry, ok = expiryFromJWT(authResp.AccessToken)
+	}
+	if !ok {
+		return
+	}
+
+	unixSeconds := strconv.FormatInt(expiry.Unix(), 10)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     "token_meta",
+		Value:    unixSeconds + "." + a.signMeta(unixSeconds),
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   true,
-		// Optionally, add SameSite, Expires, etc.
+	})
+}
+
+// writeTokenCookie stores the access token, chunking it across token_0,
+// token_1, ... cookies (plus a token_chunks count cookie) when it exceeds
+// maxCookieBytes. It also cleans up any chunk cookies left over from a
+// previous, larger token.
+func (a *AuthPlugin) writeTokenCookie(rw http.ResponseWriter, req *http.Request, value string) {
+	oldChunkCount := a.existingChunkCount(req)
+
+	if len(value) <= a.maxCookieBytes {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     "token",
+			Value:    value,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+			// Optionally, add SameSite, Expires, etc.
+		})
+		a.clearTokenChunks(rw, 0, oldChunkCount)
+		if oldChunkCount > 0 {
+			http.SetCookie(rw, &http.Cookie{Name: "token_chunks", Value: "", Path: "/", MaxAge: -1})
+		}
+		return
 	}
-	http.SetCookie(rw, cookie)
 
-	// Continue with the next handler.
-	a.next.ServeHTTP(rw, req)
+	chunks := chunkString(value, a.maxCookieBytes)
+	for i, chunk := range chunks {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     fmt.Sprintf("token_%d", i),
+			Value:    chunk,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+		})
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     "token_chunks",
+		Value:    strconv.Itoa(len(chunks)),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+	})
+	// The unchunked cookie may still be set from a previously short token.
+	http.SetCookie(rw, &http.Cookie{Name: "token", Value: "", Path: "/", MaxAge: -1})
+	a.clearTokenChunks(rw, len(chunks), oldChunkCount)
+}
+
+// chunkString splits s into pieces of at most size bytes each.
+func chunkString(s string, size int) []string {
+	var chunks []string
+	for len(s) > size {
+		chunks = append(chunks, s[:size])
+		s = s[size:]
+	}
+	return append(chunks, s)
+}
+
+// existingChunkCount reads the token_chunks cookie from a previous response,
+// if any, so stale chunks can be cleaned up when the token shrinks.
+func (a *AuthPlugin) existingChunkCount(req *http.Request) int {
+	chunksCookie, err := req.Cookie("token_chunks")
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(chunksCookie.Value)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// clearTokenChunks expires the token_<i> cookies in [from, upTo), used to
+// drop chunks left over when a new token needs fewer of them.
+func (a *AuthPlugin) clearTokenChunks(rw http.ResponseWriter, from, upTo int) {
+	for i := from; i < upTo; i++ {
+		http.SetCookie(rw, &http.Cookie{
+			Name:   fmt.Sprintf("token_%d", i),
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+}
+
+// clearAuthCookies expires the access (including any chunks), refresh and
+// metadata cookies.
+func (a *AuthPlugin) clearAuthCookies(rw http.ResponseWriter, req *http.Request) {
+	for _, name := range []string{"token", "refresh_token", "token_meta", "token_chunks", "token_sig"} {
+		http.SetCookie(rw, &http.Cookie{
+			Name:   name,
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+	a.clearTokenChunks(rw, 0, a.existingChunkCount(req))
 }
 
-// main() is provided for local testing purposes. In a production Traefik deployment,
-// Traefik would load the plugin using the New() factory.
+// main() is provided for local testing purposes. In a production Traefik
+// deployment, Traefik would load the plugin using the New() factory.
 func main() {
 	// A simple downstream handler that echoes "OK".
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
@@ -2,12 +2,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
-	"context"
 )
 
 // fakeAuthServer creates a test HTTP server simulating the auth server.
@@ -105,4 +110,566 @@ func TestAuthPluginUnauthorized(t *testing.T) {
 	if rec.Result().StatusCode != http.StatusUnauthorized {
 		t.Errorf("expected status %d for unauthorized request, got %d", http.StatusUnauthorized, rec.Result().StatusCode)
 	}
-}
\ No newline at end of file
+}
+
+func TestAuthPluginCookieChunking(t *testing.T) {
+	longToken := strings.Repeat("a", 100)
+
+	fakeServer := fakeAuthServer(t, http.StatusOK, longToken)
+	defer fakeServer.Close()
+
+	cfg := &Config{
+		Conf:           fakeServer.URL,
+		Timeout:        5 * time.Second,
+		MaxCookieBytes: 40,
+	}
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+	authPlugin := plugin.(*AuthPlugin)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("x-api-key", "dummy")
+	req.Header.Set("x-account", "dummy")
+
+	rec := httptest.NewRecorder()
+	authPlugin.ServeHTTP(rec, req)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	byName := map[string]*http.Cookie{}
+	for _, c := range res.Cookies() {
+		byName[c.Name] = c
+	}
+
+	chunksCookie, ok := byName["token_chunks"]
+	if !ok {
+		t.Fatal("expected a token_chunks cookie to be set for an oversized token")
+	}
+	n, err := strconv.Atoi(chunksCookie.Value)
+	if err != nil || n < 2 {
+		t.Fatalf("expected token_chunks >= 2, got %q", chunksCookie.Value)
+	}
+
+	// Reassemble the token from the chunk cookies, as a subsequent request would.
+	reassembleReq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for i := 0; i < n; i++ {
+		chunk, ok := byName[fmt.Sprintf("token_%d", i)]
+		if !ok {
+			t.Fatalf("expected cookie token_%d to be set", i)
+		}
+		reassembleReq.AddCookie(chunk)
+	}
+	reassembleReq.AddCookie(chunksCookie)
+
+	got, err := authPlugin.readTokenCookie(reassembleReq)
+	if err != nil {
+		t.Fatalf("readTokenCookie failed: %v", err)
+	}
+	if got != longToken {
+		t.Errorf("expected reassembled token %q, got %q", longToken, got)
+	}
+}
+
+func TestAuthPluginCookieChunkShrinkCleanup(t *testing.T) {
+	shortToken := "short-token"
+
+	fakeServer := fakeAuthServer(t, http.StatusOK, shortToken)
+	defer fakeServer.Close()
+
+	cfg := &Config{
+		Conf:           fakeServer.URL,
+		Timeout:        5 * time.Second,
+		MaxCookieBytes: 40,
+	}
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+	authPlugin := plugin.(*AuthPlugin)
+
+	// Simulate a request carrying chunk cookies left over from a previous,
+	// longer token.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("x-api-key", "dummy")
+	req.Header.Set("x-account", "dummy")
+	req.AddCookie(&http.Cookie{Name: "token_chunks", Value: "4"})
+	for i := 0; i < 4; i++ {
+		req.AddCookie(&http.Cookie{Name: fmt.Sprintf("token_%d", i), Value: "stale"})
+	}
+
+	rec := httptest.NewRecorder()
+	authPlugin.ServeHTTP(rec, req)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	found := map[string]*http.Cookie{}
+	for _, c := range res.Cookies() {
+		found[c.Name] = c
+	}
+
+	tokenCookie, ok := found["token"]
+	if !ok || tokenCookie.Value != shortToken {
+		t.Fatalf("expected plain token cookie %q, got %+v", shortToken, tokenCookie)
+	}
+
+	for i := 0; i < 4; i++ {
+		chunk, ok := found[fmt.Sprintf("token_%d", i)]
+		if !ok {
+			t.Fatalf("expected stale chunk cookie token_%d to be cleared", i)
+		}
+		if chunk.MaxAge != -1 {
+			t.Errorf("expected token_%d to be expired with MaxAge=-1, got %d", i, chunk.MaxAge)
+		}
+	}
+}
+
+// fakeAuthzPlugin creates a test HTTP server simulating an authz plugin.
+func fakeAuthzPlugin(t *testing.T, resp authzResponse) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("could not decode authz request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Fatalf("could not encode authz response: %v", err)
+		}
+	})
+	return httptest.NewServer(handler)
+}
+
+func TestAuthPluginAuthzAllow(t *testing.T) {
+	authzServer := fakeAuthzPlugin(t, authzResponse{
+		Allow:           true,
+		ModifiedHeaders: map[string]string{"x-tenant-role": "admin"},
+	})
+	defer authzServer.Close()
+
+	nextCalled := false
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+		if got := r.Header.Get("x-tenant-role"); got != "admin" {
+			t.Errorf("expected ModifiedHeaders to be merged, got x-tenant-role=%q", got)
+		}
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{AuthzPlugins: []string{authzServer.URL}}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, req)
+
+	if !nextCalled {
+		t.Error("expected next handler to be called when authz plugin allows the request")
+	}
+}
+
+func TestAuthPluginAuthzDeny(t *testing.T) {
+	authzServer := fakeAuthzPlugin(t, authzResponse{Allow: false, Msg: "denied by policy"})
+	defer authzServer.Close()
+
+	nextHandler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		t.Fatal("next handler should not be called when authz plugin denies the request")
+	})
+
+	cfg := &Config{AuthzPlugins: []string{authzServer.URL}}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, req)
+
+	if rec.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Result().StatusCode)
+	}
+}
+
+func TestAuthPluginAuthzRejectsOversizedBody(t *testing.T) {
+	authzServer := fakeAuthzPlugin(t, authzResponse{Allow: true})
+	defer authzServer.Close()
+
+	nextHandler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		t.Fatal("next handler should not be called for a body over the limit")
+	})
+
+	cfg := &Config{AuthzPlugins: []string{authzServer.URL}, RequestBodyLimit: 4}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("too big"))
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, req)
+
+	if rec.Result().StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, rec.Result().StatusCode)
+	}
+}
+
+func TestAuthPluginAuthzForwardsFullBodyUnderLimit(t *testing.T) {
+	authzServer := fakeAuthzPlugin(t, authzResponse{Allow: true})
+	defer authzServer.Close()
+
+	const payload = "fits"
+	var gotBody string
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("failed to read forwarded body: %v", err)
+		}
+		gotBody = string(body)
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{AuthzPlugins: []string{authzServer.URL}, RequestBodyLimit: int64(len(payload))}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(payload))
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, req)
+
+	if rec.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Result().StatusCode)
+	}
+	if gotBody != payload {
+		t.Errorf("expected next handler to receive full body %q, got %q", payload, gotBody)
+	}
+}
+
+func TestAuthPluginSkipPaths(t *testing.T) {
+	nextCalled := false
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		nextCalled = true
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{
+		Conf:      "http://dummy/auth",
+		SkipPaths: []string{"/.well-known/acme-challenge/*", "/healthz"},
+	}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	for _, path := range []string{"/.well-known/acme-challenge/token123", "/healthz"} {
+		nextCalled = false
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		rec := httptest.NewRecorder()
+		plugin.ServeHTTP(rec, req)
+		if !nextCalled {
+			t.Errorf("expected path %q to skip auth and reach next handler", path)
+		}
+	}
+}
+
+func TestAuthPluginRequireHeadersPaths(t *testing.T) {
+	var sawTenantRole string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawTenantRole = r.Header.Get("x-tenant-role")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(authResponse{AccessToken: "test-token"})
+	}))
+	defer authServer.Close()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{
+		Conf:                authServer.URL,
+		RequireHeadersPaths: map[string][]string{"/admin": {"x-tenant-role"}},
+	}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/admin/settings", nil)
+	req.Header.Set("x-api-key", "dummy")
+	req.Header.Set("x-account", "dummy")
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, req)
+
+	if rec.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d without x-tenant-role, got %d", http.StatusUnauthorized, rec.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/admin/settings", nil)
+	req.Header.Set("x-api-key", "dummy")
+	req.Header.Set("x-account", "dummy")
+	req.Header.Set("x-tenant-role", "owner")
+	rec = httptest.NewRecorder()
+	plugin.ServeHTTP(rec, req)
+
+	if rec.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected status %d with x-tenant-role set, got %d", http.StatusOK, rec.Result().StatusCode)
+	}
+	if sawTenantRole != "owner" {
+		t.Errorf("expected x-tenant-role to be forwarded to the auth server, got %q", sawTenantRole)
+	}
+}
+
+func TestAuthPluginSessionBindingHostReplay(t *testing.T) {
+	fakeServer := fakeAuthServer(t, http.StatusOK, "test-token")
+	defer fakeServer.Close()
+
+	cfg := &Config{
+		Conf:          fakeServer.URL,
+		SigningSecret: "super-secret",
+	}
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	issueReq := httptest.NewRequest(http.MethodGet, "http://tenant-a.example.com/", nil)
+	issueReq.Host = "tenant-a.example.com"
+	issueReq.Header.Set("x-api-key", "dummy")
+	issueReq.Header.Set("x-account", "dummy")
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, issueReq)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	replayReq := httptest.NewRequest(http.MethodGet, "http://tenant-b.example.com/", nil)
+	replayReq.Host = "tenant-b.example.com"
+	replayReq.Header.Set("x-api-key", "dummy")
+	replayReq.Header.Set("x-account", "dummy")
+	for _, c := range res.Cookies() {
+		replayReq.AddCookie(c)
+	}
+	replayRec := httptest.NewRecorder()
+	plugin.ServeHTTP(replayRec, replayReq)
+
+	if replayRec.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d when replaying a token cookie on a different host, got %d",
+			http.StatusUnauthorized, replayRec.Result().StatusCode)
+	}
+}
+
+func TestAuthPluginSessionBindingAccountReplay(t *testing.T) {
+	fakeServer := fakeAuthServer(t, http.StatusOK, "test-token")
+	defer fakeServer.Close()
+
+	cfg := &Config{
+		Conf:          fakeServer.URL,
+		SigningSecret: "super-secret",
+		BindToAccount: true,
+	}
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	issueReq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	issueReq.Header.Set("x-api-key", "dummy")
+	issueReq.Header.Set("x-account", "tenant-a")
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, issueReq)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	replayReq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	replayReq.Header.Set("x-api-key", "dummy")
+	replayReq.Header.Set("x-account", "tenant-b")
+	for _, c := range res.Cookies() {
+		replayReq.AddCookie(c)
+	}
+	replayRec := httptest.NewRecorder()
+	plugin.ServeHTTP(replayRec, replayReq)
+
+	if replayRec.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d when replaying a token cookie against a different tenant, got %d",
+			http.StatusUnauthorized, replayRec.Result().StatusCode)
+	}
+}
+
+func TestAuthPluginRetriesOnRetryableStatus(t *testing.T) {
+	var calls int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(authResponse{AccessToken: "test-token"})
+	}))
+	defer authServer.Close()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{Conf: authServer.URL, MaxRetries: 1}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("x-api-key", "dummy")
+	req.Header.Set("x-account", "dummy")
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, req)
+
+	if rec.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected status %d after retry succeeds, got %d", http.StatusOK, rec.Result().StatusCode)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("expected 2 calls to the auth server (1 failure + 1 retry), got %d", got)
+	}
+}
+
+func TestAuthPluginBreakerOpensAndFailsClosed(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer authServer.Close()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{
+		Conf:             authServer.URL,
+		MaxRetries:       0,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+	}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("x-api-key", "dummy")
+		req.Header.Set("x-account", "dummy")
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, newReq())
+	if rec.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected first failing call to propagate %d, got %d", http.StatusServiceUnavailable, rec.Result().StatusCode)
+	}
+
+	rec = httptest.NewRecorder()
+	plugin.ServeHTTP(rec, newReq())
+	if rec.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected breaker-open call to fail closed with %d, got %d", http.StatusServiceUnavailable, rec.Result().StatusCode)
+	}
+}
+
+func TestAuthPluginBreakerOpensOnPlain500(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer authServer.Close()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{
+		Conf:             authServer.URL,
+		MaxRetries:       0,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+		MetricsPath:      "/metrics",
+	}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("x-api-key", "dummy")
+		req.Header.Set("x-account", "dummy")
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, newReq())
+	if rec.Result().StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected plain 500 to propagate unretried, got %d", rec.Result().StatusCode)
+	}
+
+	rec = httptest.NewRecorder()
+	plugin.ServeHTTP(rec, newReq())
+	if rec.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected breaker-open call to fail closed with %d, got %d", http.StatusServiceUnavailable, rec.Result().StatusCode)
+	}
+
+	metricsReq := httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil)
+	rec = httptest.NewRecorder()
+	plugin.ServeHTTP(rec, metricsReq)
+	body := rec.Body.String()
+	if !strings.Contains(body, `auth_requests_total{result="failure"} 1`) {
+		t.Errorf("expected a plain 500 to be counted as a failure, got:\n%s", body)
+	}
+}
+
+func TestAuthPluginMetricsEndpoint(t *testing.T) {
+	authServer := fakeAuthServer(t, http.StatusOK, "test-token")
+	defer authServer.Close()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	cfg := &Config{Conf: authServer.URL, MetricsPath: "/metrics"}
+	plugin, err := New(context.Background(), nextHandler, cfg, "auth_cookie")
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("x-api-key", "dummy")
+	req.Header.Set("x-account", "dummy")
+	plugin.ServeHTTP(httptest.NewRecorder(), req)
+
+	metricsReq := httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil)
+	rec := httptest.NewRecorder()
+	plugin.ServeHTTP(rec, metricsReq)
+
+	body := rec.Body.String()
+	if !strings.Contains(body, `auth_requests_total{result="success"} 1`) {
+		t.Errorf("expected metrics to report one success, got:\n%s", body)
+	}
+	if !strings.Contains(body, "auth_breaker_state 0") {
+		t.Errorf("expected breaker state 0 (closed), got:\n%s", body)
+	}
+}